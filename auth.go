@@ -0,0 +1,209 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var authFile string
+
+func init() {
+	flag.StringVar(&authFile, "auth", "", "path to a JSON file mapping users to per-tenant credentials for private modules")
+}
+
+// Authenticator maps an incoming HTTP request to the tenant it belongs to.
+// It is consulted by ops.NewContext; a nil Authenticator (the default)
+// leaves every request unauthenticated and sharing the global cache.
+type Authenticator interface {
+	// Authenticate returns the Credentials for r, nil if r is
+	// unauthenticated but still allowed through, or an error if r's
+	// credentials are present but invalid.
+	Authenticate(r *http.Request) (*Credentials, error)
+}
+
+var authenticator Authenticator
+
+// Credentials scopes a single tenant's requests: the environment download()
+// and the native codehost checkouts run under, and the cache partition
+// their results are written to.
+type Credentials struct {
+	// Fingerprint identifies the tenant and partitions downloadRoot; it
+	// must not leak the underlying credential, since it appears in cache
+	// paths on disk.
+	Fingerprint string
+	// Netrc, if set, is a .netrc file scoped to this tenant.
+	Netrc string
+	// SSHKey, if set, is an SSH private key to present for git+ssh fetches.
+	SSHKey string
+	// GoPrivate mirrors $GOPRIVATE for this tenant.
+	GoPrivate string
+	// GoNoSumCheck mirrors $GONOSUMCHECK for this tenant.
+	GoNoSumCheck string
+}
+
+type credentialsKeyType struct{}
+
+var credentialsKey credentialsKeyType
+
+func withCredentials(ctx context.Context, c *Credentials) context.Context {
+	return context.WithValue(ctx, credentialsKey, c)
+}
+
+// credentialsFrom returns the Credentials NewContext attached to ctx, or
+// nil if the request was unauthenticated or no Authenticator is configured.
+func credentialsFrom(ctx context.Context) *Credentials {
+	c, _ := ctx.Value(credentialsKey).(*Credentials)
+	return c
+}
+
+// fingerprint derives a stable, filesystem-safe partition key from a
+// tenant's user name in the -auth file, so every credential of one tenant
+// shares a cache partition and cache directories on disk never contain a
+// credential.
+func fingerprint(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// env returns the environment download() and the codehost checkouts should
+// run under for c, scoping GOPATH/HOME to this tenant's cache partition and
+// adding GIT_SSH_COMMAND when an SSH key is mapped. A nil *Credentials
+// (unauthenticated request, or auth disabled) returns base unchanged.
+func (c *Credentials) env(base []string) []string {
+	if c == nil {
+		return base
+	}
+	home := filepath.Join(downloadRoot, "tenants", c.Fingerprint, "home")
+	os.MkdirAll(home, 0700)
+	env := append(append([]string{}, base...),
+		"HOME="+home,
+		"GOPATH="+filepath.Join(downloadRoot, "tenants", c.Fingerprint, "gopath"),
+	)
+	if c.Netrc != "" {
+		env = append(env, "NETRC="+c.Netrc)
+	}
+	if c.SSHKey != "" {
+		env = append(env, "GIT_SSH_COMMAND=ssh -o ControlMaster=no -i "+c.SSHKey)
+	}
+	if c.GoPrivate != "" {
+		env = append(env, "GOPRIVATE="+c.GoPrivate)
+	}
+	if c.GoNoSumCheck != "" {
+		env = append(env, "GONOSUMCHECK="+c.GoNoSumCheck)
+	}
+	return env
+}
+
+// rootFor returns the downloadRoot partition ctx's tenant should be cached
+// under, so different tenants of a shared proxy never see each other's
+// cache entries.
+func rootFor(ctx context.Context) string {
+	if c := credentialsFrom(ctx); c != nil {
+		return filepath.Join(downloadRoot, "tenants", c.Fingerprint, "cache")
+	}
+	return downloadRoot
+}
+
+// fileAuthenticator is a simple Authenticator backed by a JSON file of the
+// form {"user": {"password": "...", "token": "...", "certCN": "...", ...}},
+// enabled with -auth. Requests are matched by HTTP Basic auth, a bearer
+// token, or the CN of a client certificate, each against its own namespace
+// so a username alone is never enough to authenticate as that tenant.
+type fileAuthenticator struct {
+	byBasic map[string]*Credentials
+	byToken map[string]*Credentials
+	byCN    map[string]*Credentials
+}
+
+func loadAuthenticator(file string) (Authenticator, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cfg map[string]struct {
+		Password     string
+		Token        string
+		CertCN       string
+		Netrc        string
+		SSHKey       string
+		GoPrivate    string
+		GoNoSumCheck string
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	a := &fileAuthenticator{
+		byBasic: make(map[string]*Credentials),
+		byToken: make(map[string]*Credentials),
+		byCN:    make(map[string]*Credentials),
+	}
+	for user, u := range cfg {
+		c := &Credentials{
+			Fingerprint:  fingerprint(user),
+			Netrc:        u.Netrc,
+			SSHKey:       u.SSHKey,
+			GoPrivate:    u.GoPrivate,
+			GoNoSumCheck: u.GoNoSumCheck,
+		}
+		if u.Password != "" {
+			a.byBasic[user+":"+u.Password] = c
+		}
+		if u.Token != "" {
+			a.byToken[u.Token] = c
+		}
+		if u.CertCN != "" {
+			a.byCN[u.CertCN] = c
+		}
+	}
+	return a, nil
+}
+
+func (a *fileAuthenticator) Authenticate(r *http.Request) (*Credentials, error) {
+	if user, pass, ok := r.BasicAuth(); ok {
+		if c, ok := a.byBasic[user+":"+pass]; ok {
+			return c, nil
+		}
+		return nil, fmt.Errorf("invalid credentials for %q", user)
+	}
+	if tok := bearerToken(r); tok != "" {
+		if c, ok := a.byToken[tok]; ok {
+			return c, nil
+		}
+		return nil, fmt.Errorf("unknown bearer token")
+	}
+	if cn := clientCertCN(r); cn != "" {
+		if c, ok := a.byCN[cn]; ok {
+			return c, nil
+		}
+		return nil, fmt.Errorf("unknown client certificate %q", cn)
+	}
+	return nil, nil
+}
+
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, prefix) {
+		return strings.TrimPrefix(h, prefix)
+	}
+	return ""
+}
+
+func clientCertCN(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
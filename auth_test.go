@@ -0,0 +1,57 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadAuthenticatorKeysAreNamespaced(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "auth.json")
+	const cfg = `{
+		"alice": {"password": "hunter2", "token": "tok-alice"},
+		"bob": {"password": "swordfish"}
+	}`
+	if err := ioutil.WriteFile(file, []byte(cfg), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := loadAuthenticator(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A bearer token equal to a configured username, with no token of its
+	// own, must not authenticate - this is the bug the separate byToken
+	// namespace exists to close.
+	req := httptest.NewRequest(http.MethodGet, "/bob", nil)
+	req.Header.Set("Authorization", "Bearer bob")
+	if c, err := a.Authenticate(req); err == nil {
+		t.Errorf("Authenticate(Bearer bob) = %+v, nil; want an error", c)
+	}
+
+	// The real token for a tenant that has one still works.
+	req = httptest.NewRequest(http.MethodGet, "/alice", nil)
+	req.Header.Set("Authorization", "Bearer tok-alice")
+	c, err := a.Authenticate(req)
+	if err != nil {
+		t.Fatalf("Authenticate(Bearer tok-alice): %v", err)
+	}
+	if c == nil || c.Fingerprint != fingerprint("alice") {
+		t.Errorf("Authenticate(Bearer tok-alice) = %+v; want alice's credentials", c)
+	}
+
+	// Basic auth still works for a tenant with no token configured at all.
+	req = httptest.NewRequest(http.MethodGet, "/bob", nil)
+	req.SetBasicAuth("bob", "swordfish")
+	if c, err := a.Authenticate(req); err != nil || c == nil {
+		t.Errorf("Authenticate(bob:swordfish) = %+v, %v; want bob's credentials", c, err)
+	}
+}
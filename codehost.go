@@ -0,0 +1,455 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/sumdb/dirhash"
+	"golang.org/x/sync/singleflight"
+)
+
+// downloadGroup coalesces concurrent downloads of the same module@version
+// into a single codehost fetch, so a burst of requests for a version that
+// isn't cached yet doesn't spawn one clone per request.
+var downloadGroup singleflight.Group
+
+// vcsCmd drives a single version control tool directly, the way cmd/go's
+// own modfetch/codehost package does, instead of shelling out to the go
+// command itself. Only the handful of operations the proxy needs are
+// modeled: listing tags/refs and materializing a single revision.
+type vcsCmd struct {
+	name string
+	// tags lists the tag or bookmark names and their revision hashes.
+	tags func(repo string, env []string) (map[string]string, error)
+	// checkout writes a clean tree for rev from repo into dir, running
+	// under env (nil inherits the process's own environment; a tenant's
+	// Credentials.env supplies GIT_SSH_COMMAND and friends for private
+	// repositories). It returns rev's commit time, the same value `go mod
+	// download`'s .info file reports, best-effort falling back to the
+	// current time for VCSs this package can't query it from cheaply.
+	checkout func(repo, rev, dir string, env []string) (time.Time, error)
+}
+
+var vcsGit = &vcsCmd{
+	name: "Git",
+	tags: func(repo string, env []string) (map[string]string, error) {
+		cmd := exec.Command("git", "ls-remote", "--tags", "--heads", repo)
+		cmd.Env = env
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("git ls-remote %s: %w", repo, err)
+		}
+		refs := map[string]string{}
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+			hash, ref := fields[0], fields[1]
+			ref = strings.TrimPrefix(ref, "refs/heads/")
+			ref = strings.TrimPrefix(ref, "refs/tags/")
+			ref = strings.TrimSuffix(ref, "^{}") // peeled annotated tag
+			refs[ref] = hash
+		}
+		return refs, nil
+	},
+	checkout: func(repo, rev, dir string, env []string) (time.Time, error) {
+		// A depth-1 fetch of exactly rev avoids ever materializing the
+		// repository's full history, unlike `go mod download`'s GOPATH
+		// clone.
+		bare := dir + ".git"
+		if err := runEnv(env, "", "git", "init", "--bare", "-q", bare); err != nil {
+			return time.Time{}, err
+		}
+		defer os.RemoveAll(bare)
+		if err := runEnv(env, "", "git", "-C", bare, "fetch", "--depth=1", "-q", repo, rev); err != nil {
+			return time.Time{}, err
+		}
+
+		cmd := exec.Command("git", "-C", bare, "log", "-1", "--format=%cI", "FETCH_HEAD")
+		cmd.Env = env
+		out, err := cmd.Output()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("git log: %w", err)
+		}
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(out)))
+		if err != nil {
+			return time.Time{}, fmt.Errorf("git log: parsing commit time: %w", err)
+		}
+
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return time.Time{}, err
+		}
+		archive := exec.Command("git", "-C", bare, "archive", "FETCH_HEAD")
+		archive.Env = env
+		var arOut bytes.Buffer
+		archive.Stdout = &arOut
+		if err := archive.Run(); err != nil {
+			return time.Time{}, fmt.Errorf("git archive: %w", err)
+		}
+		if err := untar(arOut.Bytes(), dir); err != nil {
+			return time.Time{}, err
+		}
+		return t, nil
+	},
+}
+
+var vcsHg = &vcsCmd{
+	name: "Mercurial",
+	// tags reports only the head of the default branch; Mercurial tags and
+	// bookmarks are not listed.
+	tags: func(repo string, env []string) (map[string]string, error) {
+		cmd := exec.Command("hg", "identify", "-r", "default", repo)
+		cmd.Env = env
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("hg identify %s: %w", repo, err)
+		}
+		fields := strings.Fields(string(out))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("hg identify %s: no output", repo)
+		}
+		return map[string]string{"default": fields[0]}, nil
+	},
+	checkout: func(repo, rev, dir string, env []string) (time.Time, error) {
+		if err := runEnv(env, "", "hg", "archive", "-r", rev, "-R", repo, dir); err != nil {
+			return time.Time{}, err
+		}
+		return commitTimeBestEffort(env, "hg", "log", "-R", repo, "-r", rev, "--template", "{date|rfc3339date}"), nil
+	},
+}
+
+var vcsSvn = &vcsCmd{
+	name: "Subversion",
+	checkout: func(repo, rev, dir string, env []string) (time.Time, error) {
+		if err := runEnv(env, "", "svn", "export", "-q", "-r", rev, repo, dir); err != nil {
+			return time.Time{}, err
+		}
+		out := commitTimeBestEffortOutput(env, "svn", "info", "-r", rev, repo)
+		if m := svnLastChangedDateRE.FindStringSubmatch(out); m != nil {
+			if t, err := time.Parse(time.RFC3339, m[1]); err == nil {
+				return t, nil
+			}
+		}
+		return time.Now().UTC(), nil
+	},
+}
+
+var svnLastChangedDateRE = regexp.MustCompile(`Last Changed Date: (\S+)`)
+
+var vcsBzr = &vcsCmd{
+	name: "Bazaar",
+	checkout: func(repo, rev, dir string, env []string) (time.Time, error) {
+		if err := runEnv(env, "", "bzr", "export", "-r", rev, dir, repo); err != nil {
+			return time.Time{}, err
+		}
+		return commitTimeBestEffort(env, "bzr", "log", "-r", rev, "--timezone=utc", repo), nil
+	},
+}
+
+// commitTimeBestEffort runs a VCS log command expected to print an RFC3339
+// timestamp on its own, returning the current time if the command fails or
+// its output doesn't parse. Used for the VCSs this package doesn't have a
+// reliable structured way to query a single revision's commit time from.
+func commitTimeBestEffort(env []string, name string, args ...string) time.Time {
+	cmd := exec.Command(name, args...)
+	cmd.Env = env
+	out, err := cmd.Output()
+	if err != nil {
+		return time.Now().UTC()
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(out)))
+	if err != nil {
+		return time.Now().UTC()
+	}
+	return t
+}
+
+// commitTimeBestEffortOutput runs a VCS command and returns its raw output,
+// or "" on failure, for callers that need to pick a timestamp out of
+// free-form text rather than a single parseable field.
+func commitTimeBestEffortOutput(env []string, name string, args ...string) string {
+	cmd := exec.Command(name, args...)
+	cmd.Env = env
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return string(out)
+}
+
+// repoRootForImport resolves a module path to its VCS kind and repository
+// root the same way the go command does for paths that aren't on a known
+// hosting service: by fetching <host>/<path>?go-get=1 and reading the
+// <meta name="go-import"> tag.
+func repoRootForImport(mpath string) (kind *vcsCmd, repo string, err error) {
+	switch {
+	case strings.HasPrefix(mpath, "github.com/"), strings.HasPrefix(mpath, "gitlab.com/"):
+		parts := strings.SplitN(mpath, "/", 4)
+		if len(parts) < 3 {
+			return nil, "", fmt.Errorf("malformed module path %q", mpath)
+		}
+		return vcsGit, "https://" + strings.Join(parts[:3], "/"), nil
+	}
+
+	resp, err := httpClient.Get("https://" + mpath + "?go-get=1")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	m := goImportRE.FindStringSubmatch(string(body))
+	if m == nil {
+		return nil, "", fmt.Errorf("no go-import meta tag found for %s", mpath)
+	}
+	switch m[1] {
+	case "git":
+		kind = vcsGit
+	case "hg":
+		kind = vcsHg
+	case "svn":
+		kind = vcsSvn
+	case "bzr":
+		kind = vcsBzr
+	default:
+		return nil, "", fmt.Errorf("unsupported vcs %q for %s", m[1], mpath)
+	}
+	return kind, m[2], nil
+}
+
+var goImportRE = regexp.MustCompile(`<meta\s+name=["']go-import["']\s+content=["'][^\s]+\s+(\w+)\s+(\S+)["']`)
+
+func firstPathElement(mpath string) string {
+	if i := strings.Index(mpath, "/"); i >= 0 {
+		return mpath[:i]
+	}
+	return mpath
+}
+
+// codehostVersions lists mpath's released versions by reading tags straight
+// from its repository, the same information `go list -m -versions` reports,
+// without spawning the go command.
+func codehostVersions(ctx context.Context, mpath string) ([]string, error) {
+	kind, repo, err := repoRootForImport(mpath)
+	if err != nil {
+		return nil, err
+	}
+	if kind.tags == nil {
+		return nil, fmt.Errorf("%s does not support listing tags", kind.name)
+	}
+	refs, err := kind.tags(repo, credentialsFrom(ctx).env(os.Environ()))
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for ref := range refs {
+		if semver.IsValid(ref) {
+			versions = append(versions, ref)
+		}
+	}
+	semver.Sort(versions)
+	return versions, nil
+}
+
+// codehostDownload is the native replacement for running `go mod download
+// -json`: it resolves the module's repository directly, checks out the
+// requested revision, and writes the standard .info/.mod/.zip/.ziphash
+// files under downloadRoot. It coalesces concurrent requests for the same
+// module@version via downloadGroup.
+func codehostDownload(ctx context.Context, m module.Version) (*downloadInfo, error) {
+	creds := credentialsFrom(ctx)
+	key := m.String()
+	if creds != nil {
+		key = creds.Fingerprint + "/" + key
+	}
+	v, err, _ := downloadGroup.Do(key, func() (interface{}, error) {
+		return codehostDownloadOnce(rootFor(ctx), creds, m)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*downloadInfo), nil
+}
+
+func codehostDownloadOnce(root string, creds *Credentials, m module.Version) (*downloadInfo, error) {
+	kind, repo, err := repoRootForImport(m.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	rev := strings.TrimSuffix(m.Version, "+incompatible")
+	if module.IsPseudoVersion(rev) {
+		rev, err = module.PseudoVersionRev(rev)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "goproxy-checkout-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "tree")
+	commitTime, err := kind.checkout(repo, rev, dir, creds.env(os.Environ()))
+	if err != nil {
+		return nil, err
+	}
+
+	escPath, err := module.EscapePath(m.Path)
+	if err != nil {
+		return nil, err
+	}
+	escVersion, err := module.EscapeVersion(m.Version)
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Join(root, escPath, "@v", escVersion)
+	if err := os.MkdirAll(filepath.Dir(base), 0777); err != nil {
+		return nil, err
+	}
+
+	d := &downloadInfo{
+		Path:    m.Path,
+		Version: m.Version,
+		Info:    base + ".info",
+		GoMod:   base + ".mod",
+		Zip:     base + ".zip",
+	}
+
+	info := fmt.Sprintf(`{"Version":%q,"Time":%q}`, m.Version, commitTime.UTC().Format(time.RFC3339))
+	if err := ioutil.WriteFile(d.Info, []byte(info), 0666); err != nil {
+		return nil, err
+	}
+
+	goMod := filepath.Join(dir, "go.mod")
+	if _, err := os.Stat(goMod); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(goMod, []byte("module "+m.Path+"\n"), 0666); err != nil {
+			return nil, err
+		}
+	}
+	if err := copyFile(goMod, d.GoMod); err != nil {
+		return nil, err
+	}
+
+	if err := zipTree(dir, m, d.Zip); err != nil {
+		return nil, err
+	}
+
+	sum, err := dirhash.HashZip(d.Zip, dirhash.Hash1)
+	if err != nil {
+		return nil, err
+	}
+	d.Sum = sum
+	if err := ioutil.WriteFile(base+".ziphash", []byte(sum), 0666); err != nil {
+		return nil, err
+	}
+
+	goModData, err := ioutil.ReadFile(d.GoMod)
+	if err != nil {
+		return nil, err
+	}
+	goModSum, err := dirhash.Hash1([]string{m.Path + "@" + m.Version + "/go.mod"}, func(string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(goModData)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.GoModSum = goModSum
+
+	return d, nil
+}
+
+func copyFile(src, dst string) error {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, b, 0666)
+}
+
+// zipTree packs dir into a module zip at the <path>@<version>/... layout
+// go mod download produces, writing it to zipPath.
+func zipTree(dir string, m module.Version, zipPath string) error {
+	f, err := os.Create(zipPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	prefix := m.Path + "@" + m.Version + "/"
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		w, err := zw.Create(prefix + filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func runEnv(env []string, dir, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, stderr.String())
+	}
+	return nil
+}
+
+// untar extracts a `git archive` tar stream into dir. It shells out to tar
+// rather than pulling in archive/tar's own extraction loop, since
+// preserving file modes and symlinks exactly the way git produced them is
+// otherwise easy to get subtly wrong.
+func untar(tarball []byte, dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	cmd := exec.Command("tar", "-x", "-C", dir)
+	cmd.Stdin = bytes.NewReader(tarball)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("tar -x: %w: %s", err, stderr.String())
+	}
+	return nil
+}
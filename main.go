@@ -6,13 +6,14 @@
 //	goproxy [-listen [host]:port] [-cacheDir /tmp]
 //
 // goproxy serves the Go module proxy HTTP protocol at the given address (default 0.0.0.0:8081).
-// It invokes the local go command to answer requests and therefore reuses
-// the current GOPATH's module download cache and configuration (GOPROXY, GOSUMDB, and so on).
+// It fetches modules directly from their version control repositories (see codehost.go)
+// and reuses the current GOPATH's module download cache as its on-disk store
+// (GOPATH's pkg/mod/cache/download, same layout `go mod download` produces).
+// Hosts it doesn't recognize fall back to invoking the local go command.
 //
 // While the proxy is running, setting GOPROXY=http://host:port will instruct the go command to use it.
-// Note that the module proxy cannot share a GOPATH with its own clients or else fetches will deadlock.
-// (The client will lock the entry as “being downloaded” before sending the request to the proxy,
-// which will then wait for the apparently-in-progress download to finish.)
+// Because the proxy fetches modules itself instead of running `go mod download` on the client's
+// behalf, it no longer needs to share a GOPATH with its own clients.
 package main
 
 import (
@@ -29,11 +30,13 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/goproxyio/goproxy/proxy"
 
+	"go.opencensus.io/trace"
 	"golang.org/x/mod/module"
 )
 
@@ -44,26 +47,52 @@ const listExpire = 5 * time.Minute
 var listen string
 var cacheDir string
 var proxyHost string
+var proxyTimeout time.Duration
+var proxyRetries int
 var excludeHost string
 var whitelistFile string
 var blacklistFile string
 
 func init() {
 	flag.StringVar(&excludeHost, "exclude", "", "exclude host pattern")
-	flag.StringVar(&proxyHost, "proxy", "", "next hop proxy for go modules")
+	flag.StringVar(&proxyHost, "proxy", "", "comma-separated chain of next hop proxies, with the same direct/off semantics as $GOPROXY")
+	flag.DurationVar(&proxyTimeout, "proxyTimeout", 30*time.Second, "per-proxy timeout before advancing to the next entry in -proxy")
+	flag.IntVar(&proxyRetries, "proxyRetries", 0, "number of retries against each proxy in -proxy before advancing to the next one")
 	flag.StringVar(&cacheDir, "cacheDir", "", "go modules cache dir")
 	flag.StringVar(&listen, "listen", "0.0.0.0:8081", "service listen address")
 	flag.StringVar(&whitelistFile, "whitelist", "", "path to a file with the whitelist rules")
 	flag.StringVar(&blacklistFile, "blacklist", "", "path to a file with the blacklist rules")
-	flag.Parse()
-
-	if os.Getenv("GIT_TERMINAL_PROMPT") == "" {
-		os.Setenv("GIT_TERMINAL_PROMPT", "0")
-	}
+	flag.StringVar(&sumdbFlag, "sumdb", "", "upstream sumdb to proxy, as \"name[+key] [url]\" (mirrors $GOSUMDB)")
+}
 
-	if os.Getenv("GIT_SSH") == "" && os.Getenv("GIT_SSH_COMMAND") == "" {
-		os.Setenv("GIT_SSH_COMMAND", "ssh -o ControlMaster=no")
+// parseProxyChain parses the -proxy flag using the same rules cmd/go
+// documents for $GOPROXY (see `go help goproxy`): a comma-separated list of
+// proxy URLs tried in order, falling through to the local go command on
+// "direct" or failing outright on "off". Either token, if present, must be
+// the last entry in the list.
+func parseProxyChain(s string) (backends []string, direct, off bool, err error) {
+	for i, tok := range strings.Split(s, ",") {
+		tok = strings.TrimSpace(tok)
+		if tok == "" {
+			return nil, false, false, fmt.Errorf("invalid -proxy: empty entry")
+		}
+		last := i == len(strings.Split(s, ","))-1
+		switch tok {
+		case "direct":
+			if !last {
+				return nil, false, false, fmt.Errorf("invalid -proxy: %q must be the last entry", "direct")
+			}
+			direct = true
+		case "off":
+			if !last {
+				return nil, false, false, fmt.Errorf("invalid -proxy: %q must be the last entry", "off")
+			}
+			off = true
+		default:
+			backends = append(backends, tok)
+		}
 	}
+	return backends, direct, off, nil
 }
 
 func loadRules(file string) ([]*regexp.Regexp, error) {
@@ -88,6 +117,15 @@ func loadRules(file string) ([]*regexp.Regexp, error) {
 }
 
 func main() {
+	flag.Parse()
+
+	if os.Getenv("GIT_TERMINAL_PROMPT") == "" {
+		os.Setenv("GIT_TERMINAL_PROMPT", "0")
+	}
+	if os.Getenv("GIT_SSH") == "" && os.Getenv("GIT_SSH_COMMAND") == "" {
+		os.Setenv("GIT_SSH_COMMAND", "ssh -o ControlMaster=no")
+	}
+
 	log.SetPrefix("goproxy.io: ")
 	log.SetFlags(0)
 	// TODO flags
@@ -117,30 +155,90 @@ func main() {
 		log.Fatalf("could not load blacklist: %s", err.Error())
 	}
 
+	if authFile != "" {
+		authenticator, err = loadAuthenticator(authFile)
+		if err != nil {
+			log.Fatalf("could not load -auth: %s", err.Error())
+		}
+	}
+
+	if sumdbFlag != "" {
+		sumdbName, sumdbKey, sumdbURL, err = parseSumDBFlag(sumdbFlag)
+		if err != nil {
+			log.Fatalf("could not parse -sumdb: %s", err.Error())
+		}
+		log.Printf("SumDB %s %s\n", sumdbName, sumdbURL)
+	}
+
 	o := ops{
 		whiteList: whiteRules,
 		blackList: blackRules,
 	}
 
-	var handle http.Handler
+	var moduleHandler http.Handler
 	if proxyHost != "" {
+		backends, direct, off, err := parseProxyChain(proxyHost)
+		if err != nil {
+			log.Fatalf("could not parse -proxy: %s", err.Error())
+		}
 		log.Printf("ProxyHost %s\n", proxyHost)
 		if excludeHost != "" {
 			log.Printf("ExcludeHost %s\n", excludeHost)
 		}
-		handle = &logger{proxy.NewRouter(proxy.NewServer(&o), &proxy.RouterOptions{
-			Pattern: excludeHost,
-			Proxy:   proxyHost,
-		})}
+		moduleHandler, err = newProxyChain(proxy.NewServer(&o), excludeHost, backends, direct, off, proxyTimeout, proxyRetries)
+		if err != nil {
+			log.Fatalf("could not build -proxy chain: %s", err.Error())
+		}
 	} else {
-		handle = &logger{proxy.NewServer(&o)}
+		moduleHandler = proxy.NewServer(&o)
+	}
+
+	w := newWarmer(&o)
+	if warmFlag != "" {
+		list, err := listAll(filepath.Dir(warmFlag))
+		if err != nil {
+			log.Fatalf("could not warm from %s: %s", warmFlag, err.Error())
+		}
+		for _, m := range list {
+			w.start(m)
+		}
+	}
+	if warmPinnedFile != "" {
+		pinned, err := loadPinned(warmPinnedFile)
+		if err != nil {
+			log.Fatalf("could not load -warmPinned: %s", err.Error())
+		}
+		for _, m := range pinned {
+			w.start(m)
+		}
+		w.schedulePinned(pinned)
 	}
-	log.Fatal(http.ListenAndServe(listen, handle))
+
+	mux := http.NewServeMux()
+	mux.Handle("/warm/", w.Handler())
+	if sumdbName != "" {
+		mux.Handle("/sumdb/", sumdbHandler(&o))
+	}
+	mux.Handle("/", moduleHandler)
+
+	if metricsListen != "" {
+		serveMetrics(metricsListen)
+	}
+
+	log.Fatal(http.ListenAndServe(listen, &logger{mux}))
 }
 
 // goJSON runs the go command and parses its JSON output into dst.
 func goJSON(dst interface{}, command ...string) error {
+	return goJSONEnv(nil, dst, command...)
+}
+
+// goJSONEnv is goJSON with an explicit environment, used to run the go
+// command scoped to one tenant's GOPATH/HOME/SSH key. A nil env inherits
+// the process's own environment, same as goJSON.
+func goJSONEnv(env []string, dst interface{}, command ...string) error {
 	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = env
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
@@ -167,10 +265,23 @@ func (r *responseLogger) WriteHeader(code int) {
 	r.ResponseWriter.WriteHeader(code)
 }
 func (l *logger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, span := trace.StartSpan(r.Context(), "goproxy.request")
+	defer span.End()
+	r = r.WithContext(ctx)
+
 	start := time.Now()
 	rl := &responseLogger{code: 200, ResponseWriter: w}
 	l.h.ServeHTTP(rl, r)
-	log.Printf("%.3fs %d %s\n", time.Since(start).Seconds(), rl.code, r.URL)
+	elapsed := time.Since(start)
+	log.Printf("%.3fs %d %s\n", elapsed.Seconds(), rl.code, r.URL)
+
+	if rl.code >= 400 {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: http.StatusText(rl.code)})
+	}
+
+	route := routeLabel(r)
+	requestsTotal.WithLabelValues(route, strconv.Itoa(rl.code)).Inc()
+	requestDuration.WithLabelValues(route).Observe(elapsed.Seconds())
 }
 
 // An ops is a proxy.ServerOps implementation.
@@ -179,8 +290,37 @@ type ops struct{
 	blackList []*regexp.Regexp
 }
 
+// contextKey is an unexported type for keys defined in this package,
+// following the convention recommended by the context package itself so
+// they never collide with keys from other packages.
+type contextKey int
+
+const disableModuleFetchKey contextKey = 0
+
 func (*ops) NewContext(r *http.Request) (context.Context, error) {
-	return context.Background(), nil
+	ctx := context.Background()
+	if r.Header.Get("Disable-Module-Fetch") == "true" {
+		ctx = context.WithValue(ctx, disableModuleFetchKey, true)
+	}
+	if authenticator != nil {
+		creds, err := authenticator.Authenticate(r)
+		if err != nil {
+			return nil, err
+		}
+		if creds != nil {
+			ctx = withCredentials(ctx, creds)
+		}
+	}
+	return ctx, nil
+}
+
+// disableModuleFetch reports whether the request that produced ctx carried
+// Disable-Module-Fetch: true, as sent by the pkgsite proxy client. When set,
+// download() and List must only serve from the existing cache and must
+// never shell out to the go command.
+func disableModuleFetch(ctx context.Context) bool {
+	disable, _ := ctx.Value(disableModuleFetchKey).(bool)
+	return disable
 }
 func (o *ops) isWhitelisted(ctx context.Context, path string) bool{
 	for _, r := range o.whiteList {
@@ -223,21 +363,32 @@ func (*ops) List(ctx context.Context, mpath string) (proxy.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	file := filepath.Join(downloadRoot, escMod+"/@v/listproxy")
+	file := filepath.Join(rootFor(ctx), escMod+"/@v/listproxy")
 	if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) < listExpire {
 		return os.Open(file)
 	}
-	var list struct {
-		Path     string
-		Versions []string
-	}
-	if err := goJSON(&list, "go", "list", "-m", "-json", "-versions", mpath+"@latest"); err != nil {
-		return nil, err
+	if disableModuleFetch(ctx) {
+		if _, err := os.Stat(file); err == nil {
+			return os.Open(file)
+		}
+		return nil, os.ErrNotExist
 	}
-	if list.Path != mpath {
-		return nil, fmt.Errorf("go list -m: asked for %s but got %s", mpath, list.Path)
+	versions, err := codehostVersions(ctx, mpath)
+	if err != nil {
+		var list struct {
+			Path     string
+			Versions []string
+		}
+		env := credentialsFrom(ctx).env(os.Environ())
+		if err := goJSONEnv(env, &list, "go", "list", "-m", "-json", "-versions", mpath+"@latest"); err != nil {
+			return nil, err
+		}
+		if list.Path != mpath {
+			return nil, fmt.Errorf("go list -m: asked for %s but got %s", mpath, list.Path)
+		}
+		versions = list.Versions
 	}
-	data := []byte(strings.Join(list.Versions, "\n") + "\n")
+	data := []byte(strings.Join(versions, "\n") + "\n")
 	if len(data) == 1 {
 		data = nil
 	}
@@ -249,28 +400,28 @@ func (*ops) List(ctx context.Context, mpath string) (proxy.File, error) {
 	return os.Open(file)
 }
 func (*ops) Latest(ctx context.Context, path string) (proxy.File, error) {
-	d, err := download(module.Version{Path: path, Version: "latest"})
+	d, err := download(ctx, module.Version{Path: path, Version: "latest"})
 	if err != nil {
 		return nil, err
 	}
 	return os.Open(d.Info)
 }
 func (*ops) Info(ctx context.Context, m module.Version) (proxy.File, error) {
-	d, err := download(m)
+	d, err := download(ctx, m)
 	if err != nil {
 		return nil, err
 	}
 	return os.Open(d.Info)
 }
 func (*ops) GoMod(ctx context.Context, m module.Version) (proxy.File, error) {
-	d, err := download(m)
+	d, err := download(ctx, m)
 	if err != nil {
 		return nil, err
 	}
 	return os.Open(d.GoMod)
 }
 func (*ops) Zip(ctx context.Context, m module.Version) (proxy.File, error) {
-	d, err := download(m)
+	d, err := download(ctx, m)
 	if err != nil {
 		return nil, err
 	}
@@ -288,7 +439,86 @@ type downloadInfo struct {
 	GoModSum string
 }
 
-func download(m module.Version) (*downloadInfo, error) {
-	d := new(downloadInfo)
-	return d, goJSON(d, "go", "mod", "download", "-json", m.String())
+// download resolves m to an on-disk .info/.mod/.zip triple, preferring the
+// in-process codehost path (codehostDownload) so that concurrent requests
+// for the same module@version coalesce into one fetch and so this proxy
+// never shares a GOPATH with its own clients. If the module's host isn't
+// recognized by the native codehost support, it falls back to the original
+// `go mod download` path.
+func download(ctx context.Context, m module.Version) (*downloadInfo, error) {
+	if disableModuleFetch(ctx) {
+		cacheResults.WithLabelValues("disable-module-fetch").Inc()
+		return cachedDownloadInfo(ctx, m)
+	}
+
+	// "latest" isn't a real, immutable version: re-resolving it is the
+	// whole point of ops.Latest, so it must never be served out of a
+	// previously cached latest.info/.mod/.zip the way a pinned version is.
+	if m.Version != "latest" {
+		if d, err := cachedDownloadInfo(ctx, m); err == nil {
+			cacheResults.WithLabelValues("hit").Inc()
+			return d, nil
+		}
+	}
+	cacheResults.WithLabelValues("miss").Inc()
+
+	var d *downloadInfo
+	err := traceDownload(ctx, "codehost", func(ctx context.Context) error {
+		var err error
+		d, err = codehostDownload(ctx, m)
+		return err
+	})
+	if err == nil {
+		bytesServedTotal.Add(float64(fileSize(d.Zip)))
+		return d, nil
+	}
+
+	d = new(downloadInfo)
+	env := credentialsFrom(ctx).env(os.Environ())
+	err = traceDownload(ctx, "go-mod-download", func(context.Context) error {
+		return goJSONEnv(env, d, "go", "mod", "download", "-json", m.String())
+	})
+	if err != nil {
+		return nil, err
+	}
+	bytesServedTotal.Add(float64(fileSize(d.Zip)))
+	return d, nil
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// cachedDownloadInfo serves a downloadInfo straight from downloadRoot
+// without invoking the go command, for requests that set
+// Disable-Module-Fetch. It reconstructs the file layout that
+// `go mod download` would have produced, and fails with os.ErrNotExist if
+// any of the three files is missing from the cache.
+func cachedDownloadInfo(ctx context.Context, m module.Version) (*downloadInfo, error) {
+	escPath, err := module.EscapePath(m.Path)
+	if err != nil {
+		return nil, err
+	}
+	escVersion, err := module.EscapeVersion(m.Version)
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Join(rootFor(ctx), escPath, "@v", escVersion)
+	d := &downloadInfo{
+		Path:    m.Path,
+		Version: m.Version,
+		Info:    base + ".info",
+		GoMod:   base + ".mod",
+		Zip:     base + ".zip",
+	}
+	for _, f := range []string{d.Info, d.GoMod, d.Zip} {
+		if _, err := os.Stat(f); err != nil {
+			return nil, os.ErrNotExist
+		}
+	}
+	return d, nil
 }
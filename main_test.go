@@ -0,0 +1,54 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestParseProxyChain(t *testing.T) {
+	tests := []struct {
+		in           string
+		wantBackends []string
+		wantDirect   bool
+		wantOff      bool
+		wantErr      bool
+	}{
+		{in: "https://a.example,https://b.example", wantBackends: []string{"https://a.example", "https://b.example"}},
+		{in: "https://a.example,direct", wantBackends: []string{"https://a.example"}, wantDirect: true},
+		{in: "https://a.example,off", wantBackends: []string{"https://a.example"}, wantOff: true},
+		{in: "direct", wantDirect: true},
+		{in: "off", wantOff: true},
+		{in: "direct,https://a.example", wantErr: true},
+		{in: "off,direct", wantErr: true},
+		{in: "https://a.example,,https://b.example", wantErr: true},
+	}
+	for _, tt := range tests {
+		backends, direct, off, err := parseProxyChain(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseProxyChain(%q): want error, got none", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseProxyChain(%q): %v", tt.in, err)
+			continue
+		}
+		if direct != tt.wantDirect || off != tt.wantOff || !stringSliceEqual(backends, tt.wantBackends) {
+			t.Errorf("parseProxyChain(%q) = %v, %v, %v; want %v, %v, %v", tt.in, backends, direct, off, tt.wantBackends, tt.wantDirect, tt.wantOff)
+		}
+	}
+}
+
+func stringSliceEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/zpages"
+)
+
+var metricsListen string
+
+func init() {
+	flag.StringVar(&metricsListen, "metricsListen", "", "address to serve /metrics and /debug/tracez on, separate from -listen")
+}
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_requests_total",
+		Help: "Module proxy requests by route and response code.",
+	}, []string{"route", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "goproxy_request_duration_seconds",
+		Help: "Module proxy request latency by route.",
+	}, []string{"route"})
+
+	cacheResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_cache_results_total",
+		Help: "Cache hits and misses in download().",
+	}, []string{"result"})
+
+	fetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "goproxy_upstream_fetch_duration_seconds",
+		Help: "Time spent fetching a module from its upstream VCS or proxy.",
+	}, []string{"method"})
+
+	fetchErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_upstream_fetch_errors_total",
+		Help: "Upstream fetch failures by method.",
+	}, []string{"method"})
+
+	bytesServedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "goproxy_bytes_served_total",
+		Help: "Total bytes of module zips fetched from upstream by download(); " +
+			"cache hits add nothing. Not labeled by " +
+			"module, the same unbounded-cardinality trap routeLabel exists to avoid.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, cacheResults, fetchDuration, fetchErrorsTotal, bytesServedTotal)
+}
+
+// httpClient is used for the proxy's own outbound fetches (sumdb lookups,
+// go-import discovery), wrapped in ochttp.Transport so they show up as
+// traced, measured client spans the same way pkgsite's proxy client wraps
+// its http.Client.
+var httpClient = &http.Client{Transport: &ochttp.Transport{}}
+
+// serveMetrics starts a separate listener for /metrics and /debug/tracez,
+// so operators can scrape Prometheus and inspect traces without exposing
+// them on the module-serving port.
+func serveMetrics(listen string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	zpages.Handle(mux, "/debug")
+	log.Printf("metrics listening on %s\n", listen)
+	go func() {
+		log.Fatal(http.ListenAndServe(listen, mux))
+	}()
+}
+
+// routeLabel collapses a request path into a small, bounded set of metric
+// label values, so per-module paths don't blow up cardinality the way a raw
+// r.URL.Path would.
+func routeLabel(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/warm/"):
+		return "warm"
+	case strings.Contains(r.URL.Path, "/sumdb/"):
+		return "sumdb"
+	case strings.HasSuffix(r.URL.Path, "/@latest"):
+		return "latest"
+	case strings.HasSuffix(r.URL.Path, "/@v/list"):
+		return "list"
+	case strings.HasSuffix(r.URL.Path, ".info"):
+		return "info"
+	case strings.HasSuffix(r.URL.Path, ".mod"):
+		return "mod"
+	case strings.HasSuffix(r.URL.Path, ".zip"):
+		return "zip"
+	default:
+		return "other"
+	}
+}
+
+// traceDownload wraps fn (a download attempt by the named method, e.g.
+// "codehost" or "go-mod-download") with an OpenCensus span and the
+// fetchDuration/fetchErrorsTotal metrics.
+func traceDownload(ctx context.Context, method string, fn func(context.Context) error) error {
+	ctx, span := trace.StartSpan(ctx, "goproxy.download/"+method)
+	defer span.End()
+
+	start := time.Now()
+	err := fn(ctx)
+	fetchDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		fetchErrorsTotal.WithLabelValues(method).Inc()
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	return err
+}
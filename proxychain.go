@@ -0,0 +1,119 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// proxyChain implements the $GOPROXY-style fallthrough semantics described
+// by -proxy: each backend is tried in turn, advancing to the next one on a
+// 404 or 410 response (or on a transport failure after -proxyRetries
+// retries), the same way the go command walks a comma-separated GOPROXY
+// list. Requests matching excludePattern bypass the chain entirely and go
+// straight to next, the proxy's own direct/native fetch path; once the
+// chain is exhausted, next is also what "direct" falls back to.
+//
+// This lives in the goproxy package itself rather than as an addition to
+// proxy.RouterOptions, since github.com/goproxyio/goproxy/proxy is a
+// separate, unmodified dependency whose NewRouter only ever understood a
+// single Pattern/Proxy pair.
+type proxyChain struct {
+	next     http.Handler
+	exclude  *regexp.Regexp
+	backends []string
+	direct   bool
+	off      bool
+	retries  int
+	client   *http.Client
+}
+
+// newProxyChain builds the http.Handler -proxy installs in front of next,
+// the local proxy.NewServer handler. excludePattern, backends, direct and
+// off come straight from parseProxyChain and -exclude.
+func newProxyChain(next http.Handler, excludePattern string, backends []string, direct, off bool, timeout time.Duration, retries int) (http.Handler, error) {
+	c := &proxyChain{
+		next:     next,
+		backends: backends,
+		direct:   direct,
+		off:      off,
+		retries:  retries,
+		client:   &http.Client{Timeout: timeout},
+	}
+	if excludePattern != "" {
+		re, err := regexp.Compile(excludePattern)
+		if err != nil {
+			return nil, err
+		}
+		c.exclude = re
+	}
+	return c, nil
+}
+
+func (c *proxyChain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.exclude != nil && c.exclude.MatchString(r.URL.Path) {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	for _, backend := range c.backends {
+		if c.serveFromBackend(backend, w, r) {
+			return
+		}
+	}
+
+	if c.direct {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	if c.off {
+		http.Error(w, "module lookup disallowed by -proxy=...,off", http.StatusGone)
+		return
+	}
+	http.Error(w, "module not found in -proxy chain", http.StatusNotFound)
+}
+
+// serveFromBackend fetches r's path from backend and, if the response is
+// anything other than 404/410, copies it to w and reports true. A 404/410 -
+// or a transport error that survives -proxyRetries retries - reports false
+// so the caller advances to the next backend in the chain.
+func (c *proxyChain) serveFromBackend(backend string, w http.ResponseWriter, r *http.Request) bool {
+	target := strings.TrimRight(backend, "/") + r.URL.Path
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(r.Context(), http.MethodGet, target, nil)
+		if err != nil {
+			return false
+		}
+		resp, err = c.client.Do(req)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("-proxy %s: %v", backend, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return false
+	}
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return true
+}
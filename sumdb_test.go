@@ -0,0 +1,57 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestParseSumDBFlag(t *testing.T) {
+	tests := []struct {
+		in      string
+		name    string
+		key     string
+		url     string
+		wantErr bool
+	}{
+		{in: "sum.golang.org", name: "sum.golang.org", url: "https://sum.golang.org"},
+		{in: "sum.golang.org https://sum.golang.org", name: "sum.golang.org", url: "https://sum.golang.org"},
+		{in: "sum.golang.org+abc123 https://sum.golang.org", name: "sum.golang.org", key: "abc123", url: "https://sum.golang.org"},
+		{in: "sum.golang.org https://sum.golang.org/", name: "sum.golang.org", url: "https://sum.golang.org"},
+		{in: "a b c", wantErr: true},
+	}
+	for _, tt := range tests {
+		name, key, url, err := parseSumDBFlag(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSumDBFlag(%q): want error, got none", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSumDBFlag(%q): %v", tt.in, err)
+			continue
+		}
+		if name != tt.name || key != tt.key || url != tt.url {
+			t.Errorf("parseSumDBFlag(%q) = %q, %q, %q; want %q, %q, %q", tt.in, name, key, url, tt.name, tt.key, tt.url)
+		}
+	}
+}
+
+func TestModuleFromSumDBPath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "lookup/golang.org/x/mod@v0.3.0", want: "golang.org/x/mod"},
+		{in: "lookup/example.com/foo@v1.2.3", want: "example.com/foo"},
+		{in: "tile/8/1/0", want: ""},
+		{in: "lookup/no-at-sign", want: ""},
+		{in: "supported", want: ""},
+	}
+	for _, tt := range tests {
+		if got := moduleFromSumDBPath(tt.in); got != tt.want {
+			t.Errorf("moduleFromSumDBPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
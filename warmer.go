@@ -0,0 +1,276 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+var warmFlag string
+var warmPinnedFile string
+var warmInterval time.Duration
+var warmConcurrency int
+
+func init() {
+	flag.StringVar(&warmFlag, "warm", "", "path to a go.mod whose full build list should be prefetched at startup")
+	flag.StringVar(&warmPinnedFile, "warmPinned", "", "path to a file of module@version entries to periodically re-warm")
+	flag.DurationVar(&warmInterval, "warmInterval", time.Hour, "how often to re-warm the pinned module list")
+	flag.IntVar(&warmConcurrency, "warmConcurrency", 8, "max concurrent downloads while warming a build list")
+}
+
+// warmJob tracks the progress of a single warm request, keyed by the
+// module@version whose build list is being prefetched.
+type warmJob struct {
+	mu      sync.Mutex
+	total   int
+	fetched int
+	errs    []string
+	done    bool
+	started time.Time
+}
+
+func (j *warmJob) isDone() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.done
+}
+
+func (j *warmJob) status() map[string]interface{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return map[string]interface{}{
+		"total":   j.total,
+		"fetched": j.fetched,
+		"errors":  j.errs,
+		"done":    j.done,
+		"started": j.started,
+	}
+}
+
+// warmer prefetches a module's full build list into downloadRoot, the way
+// pkgsite eagerly serves every module on the build list of the modules it
+// indexes. It deduplicates in-flight requests for the same module@version
+// and bounds concurrent downloads with a worker pool.
+type warmer struct {
+	o *ops
+
+	mu   sync.Mutex
+	jobs map[string]*warmJob
+}
+
+func newWarmer(o *ops) *warmer {
+	return &warmer{o: o, jobs: make(map[string]*warmJob)}
+}
+
+// Handler serves the warmer's admin endpoints: POST /warm/<module>@<version>
+// starts (or joins) a warm job, and GET /warm/<module>@<version> reports its
+// status as JSON.
+func (w *warmer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/warm/", func(rw http.ResponseWriter, r *http.Request) {
+		mv := strings.TrimPrefix(r.URL.Path, "/warm/")
+		at := strings.LastIndex(mv, "@")
+		if at < 0 {
+			http.Error(rw, "expected /warm/<module>@<version>", http.StatusBadRequest)
+			return
+		}
+		m := module.Version{Path: mv[:at], Version: mv[at+1:]}
+
+		var job *warmJob
+		switch r.Method {
+		case http.MethodPost:
+			if !w.o.Filter(r.Context(), m.Path) {
+				http.Error(rw, "module is not allowed", http.StatusForbidden)
+				return
+			}
+			job = w.start(m)
+		case http.MethodGet:
+			w.mu.Lock()
+			job = w.jobs[m.String()]
+			w.mu.Unlock()
+			if job == nil {
+				http.Error(rw, "no warm job for "+mv, http.StatusNotFound)
+				return
+			}
+		default:
+			rw.Header().Set("Allow", "GET, POST")
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(job.status())
+	})
+	return mux
+}
+
+// start begins warming m in the background, or joins the job already
+// running for the same module@version. A job that has already finished -
+// successfully or not - is replaced with a fresh one instead of being
+// handed back, so a second start (a retried POST, or schedulePinned's
+// ticker) actually re-fetches rather than forever returning the first
+// run's now-stale result.
+func (w *warmer) start(m module.Version) *warmJob {
+	key := m.String()
+
+	w.mu.Lock()
+	if job, ok := w.jobs[key]; ok && !job.isDone() {
+		w.mu.Unlock()
+		return job
+	}
+	job := &warmJob{started: time.Now()}
+	w.jobs[key] = job
+	w.mu.Unlock()
+
+	go w.run(job, m)
+	return job
+}
+
+// run resolves m's full build list with buildList and downloads every entry
+// that passes the filter, bounded by warmConcurrency.
+func (w *warmer) run(job *warmJob, m module.Version) {
+	defer func() {
+		job.mu.Lock()
+		job.done = true
+		job.mu.Unlock()
+	}()
+
+	list, err := buildList(m)
+	if err != nil {
+		job.mu.Lock()
+		job.errs = append(job.errs, err.Error())
+		job.mu.Unlock()
+		return
+	}
+
+	job.mu.Lock()
+	job.total = len(list)
+	job.mu.Unlock()
+
+	sem := make(chan struct{}, warmConcurrency)
+	var wg sync.WaitGroup
+	for _, dep := range list {
+		if !w.o.Filter(context.Background(), dep.Path) {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(dep module.Version) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			_, err := download(context.Background(), dep)
+			job.mu.Lock()
+			if err != nil {
+				job.errs = append(job.errs, fmt.Sprintf("%s: %v", dep, err))
+			} else {
+				job.fetched++
+			}
+			job.mu.Unlock()
+		}(dep)
+	}
+	wg.Wait()
+}
+
+// buildList resolves the full build list of m by requiring it from a
+// scratch module in a temporary directory and running `go list -m -json
+// all` there, mirroring what pkgsite does to discover every module it
+// should warm. The go command runs with the proxy's own environment, so it
+// uses the proxy's GOPATH and module cache; the GOPATH is not isolated.
+func buildList(m module.Version) ([]module.Version, error) {
+	tmp, err := ioutil.TempDir("", "goproxy-warm-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	goMod := "module goproxy-warm\n\ngo 1.16\n\nrequire " + m.Path + " " + m.Version + "\n"
+	if err := ioutil.WriteFile(filepath.Join(tmp, "go.mod"), []byte(goMod), 0666); err != nil {
+		return nil, err
+	}
+
+	return listAll(tmp)
+}
+
+// listAll runs `go list -m -json all` in dir and decodes the resulting
+// stream of JSON objects into a module.Version build list, skipping the
+// synthetic main module.
+func listAll(dir string) ([]module.Version, error) {
+	cmd := exec.Command("go", "list", "-m", "-json", "all")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list -m -json all: %w", err)
+	}
+
+	var list []module.Version
+	dec := json.NewDecoder(strings.NewReader(string(out)))
+	for {
+		var entry struct {
+			Path    string
+			Version string
+			Main    bool
+		}
+		if err := dec.Decode(&entry); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if entry.Main || entry.Version == "" {
+			continue
+		}
+		list = append(list, module.Version{Path: entry.Path, Version: entry.Version})
+	}
+	return list, nil
+}
+
+// loadPinned reads a file of module@version entries, one per line, as used
+// by -warmPinned.
+func loadPinned(file string) ([]module.Version, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var pinned []module.Version
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		at := strings.LastIndex(line, "@")
+		if at < 0 {
+			return nil, fmt.Errorf("invalid -warmPinned entry %q, want module@version", line)
+		}
+		pinned = append(pinned, module.Version{Path: line[:at], Version: line[at+1:]})
+	}
+	return pinned, nil
+}
+
+// schedulePinned re-warms every module in pinned every warmInterval, so
+// CI clusters relying on this proxy always see a freshly cached tip.
+func (w *warmer) schedulePinned(pinned []module.Version) {
+	t := time.NewTicker(warmInterval)
+	go func() {
+		for range t.C {
+			for _, m := range pinned {
+				w.start(m)
+			}
+		}
+	}()
+}